@@ -11,12 +11,16 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/misc"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/trie"
 )
 
@@ -30,6 +34,7 @@ type CacheConfig struct {
 	TrieTimeLimit       time.Duration // Time limit after which to flush the current in-memory trie to disk
 	SnapshotLimit       int           // Memory allowance (MB) to use for caching snapshot entries in memory
 	Preimages           bool          // Whether to store preimage of trie key to the disk
+	PipelineCommit      bool          // Whether to pipeline trie commit in the background
 
 	SnapshotWait bool // Wait for snapshot construction on startup. TODO(karalabe): This is a dirty hack for testing, nuke it
 }
@@ -52,6 +57,17 @@ type StateDBStats struct {
 	valCacheDirty int
 	valCacheHit   int
 	valCacheMiss  int
+
+	// accountsRemoved and storageSlotsZeroed are direct counts off the
+	// replay stream, not trie-level metrics: per-commit trie node
+	// deletions and bytes freed would need a patch to the vendored
+	// go-ethereum fork to expose that accounting off Commit, and no such
+	// fork is part of this repository, so this stats block does not
+	// report them. storageSlotsZeroed is also a known undercount: a slot
+	// implicitly cleared by an account removal (removeaccount/Suicide)
+	// is not attributed here, only slots explicitly zeroed by "setstate".
+	accountsRemoved    int
+	storageSlotsZeroed int
 }
 
 func (s *StateDBStats) Update(statedb *state.StateDB) {
@@ -62,6 +78,18 @@ func (s *StateDBStats) Update(statedb *state.StateDB) {
 	s.valCacheDirty += statedb.ValCacheDirty
 }
 
+// RecordAccountRemoved counts a "removeaccount" op from the replay stream.
+func (s *StateDBStats) RecordAccountRemoved() {
+	s.accountsRemoved++
+}
+
+// RecordStorageSlotZeroed counts a "setstate" op that wrote zero to a slot
+// that was not already zero, so a no-op rewrite of an already-zero slot
+// isn't counted as a deletion.
+func (s *StateDBStats) RecordStorageSlotZeroed() {
+	s.storageSlotsZeroed++
+}
+
 func (s *StateDBStats) PrintStats() {
 	objCacheHitRatio := float64(s.objCacheHit) / math.Max(float64(s.objCacheHit+s.objCacheMiss), 1)
 	valCacheHitRatio := float64(s.valCacheHit+s.valCacheDirty) /
@@ -69,6 +97,7 @@ func (s *StateDBStats) PrintStats() {
 	fmt.Print("StateDB:\t")
 	fmt.Printf("%d\t%d\t%.3f\t", s.objCacheHit, s.objCacheMiss, objCacheHitRatio)
 	fmt.Printf("%d\t%d\t%d\t%.3f\t", s.valCacheHit, s.valCacheDirty, s.valCacheMiss, valCacheHitRatio)
+	fmt.Printf("%d\t%d\t", s.accountsRemoved, s.storageSlotsZeroed)
 	fmt.Println()
 }
 
@@ -78,10 +107,216 @@ func (s *StateDBStats) Reset() {
 	s.valCacheHit = 0
 	s.valCacheHit = 0
 	s.valCacheDirty = 0
+	s.accountsRemoved = 0
+	s.storageSlotsZeroed = 0
+}
+
+// Engine selects the on-disk key/value store backing statedb_benchmark.
+type Engine string
+
+const (
+	EngineLevelDB Engine = "leveldb"
+	EnginePebble  Engine = "pebble"
+)
+
+func openEngine(dbpath string, cachesize int, engine Engine) (ethdb.Database, error) {
+	switch engine {
+	case EnginePebble:
+		return rawdb.NewPebbleDBDatabase(dbpath, cachesize/2, 0, "", false, false)
+	default:
+		return rawdb.NewLevelDBDatabase(dbpath, cachesize/2, 0, "", false)
+	}
+}
+
+// pipelineResult carries the outcome of an asynchronous trie/snapshot flush
+// back to the main loop, along with the time it took so it can still be
+// attributed to the async-flush timer once it is drained.
+type pipelineResult struct {
+	err     error
+	elapsed float64
+}
+
+// latestRoot is a small thread-safe box the main loop publishes the
+// just-committed root into, so the prefetcher always warms state against
+// the block the replay is actually on.
+type latestRoot struct {
+	mu   sync.Mutex
+	root common.Hash
+}
+
+func (r *latestRoot) set(root common.Hash) {
+	r.mu.Lock()
+	r.root = root
+	r.mu.Unlock()
+}
+
+func (r *latestRoot) get() common.Hash {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.root
+}
+
+// prefetchStats accumulates, from the main replay's point of view, how
+// often a get landed on a key the prefetcher had already warmed ahead of
+// it. The main loop is the sole writer (via recordHit/recordMiss); it also
+// reads and resets the counters via snapshotAndReset, all through atomics
+// so the prefetcher goroutine never has to be synchronized with it.
+type prefetchStats struct {
+	hits   int64
+	misses int64
+}
+
+func (s *prefetchStats) recordHit() {
+	atomic.AddInt64(&s.hits, 1)
+}
+
+func (s *prefetchStats) recordMiss() {
+	atomic.AddInt64(&s.misses, 1)
+}
+
+func (s *prefetchStats) snapshotAndReset() (hits, misses int64) {
+	return atomic.SwapInt64(&s.hits, 0), atomic.SwapInt64(&s.misses, 0)
+}
+
+// prefetchWarm is the handoff between the prefetcher and the main loop: the
+// prefetcher marks every address/slot it reads ahead of the replay, tagged
+// with the workload line it was reading at the time, and the main loop
+// checks its own gets against those marks to see whether the prefetch
+// actually ran ahead of it in time to help. Marks are pruned by line number
+// rather than wiped wholesale, so a mark is never dropped out from under
+// the main loop's check the moment it becomes relevant.
+type prefetchWarm struct {
+	mu       sync.Mutex
+	accounts map[common.Address]int64
+	storage  map[common.Address]map[common.Hash]int64
+}
+
+func newPrefetchWarm() *prefetchWarm {
+	return &prefetchWarm{
+		accounts: make(map[common.Address]int64),
+		storage:  make(map[common.Address]map[common.Hash]int64),
+	}
+}
+
+func (w *prefetchWarm) markAccount(addr common.Address, line int64) {
+	w.mu.Lock()
+	w.accounts[addr] = line
+	w.mu.Unlock()
+}
+
+func (w *prefetchWarm) markStorage(addr common.Address, slot common.Hash, line int64) {
+	w.mu.Lock()
+	if w.storage[addr] == nil {
+		w.storage[addr] = make(map[common.Hash]int64)
+	}
+	w.storage[addr][slot] = line
+	w.mu.Unlock()
+}
+
+func (w *prefetchWarm) hitAccount(addr common.Address) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.accounts[addr]
+	return ok
+}
+
+func (w *prefetchWarm) hitStorage(addr common.Address, slot common.Hash) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, ok := w.storage[addr][slot]
+	return ok
+}
+
+// prune drops marks older than line `before`, bounding the warm set's
+// memory over a long replay without ever clearing a mark the main loop
+// could still plausibly be about to check (the caller keeps `before` well
+// behind the prefetcher's own current line).
+func (w *prefetchWarm) prune(before int64) {
+	w.mu.Lock()
+	for addr, line := range w.accounts {
+		if line < before {
+			delete(w.accounts, addr)
+		}
+	}
+	for addr, slots := range w.storage {
+		for slot, line := range slots {
+			if line < before {
+				delete(slots, slot)
+			}
+		}
+		if len(slots) == 0 {
+			delete(w.storage, addr)
+		}
+	}
+	w.mu.Unlock()
 }
 
-func statedb_benchmark(dbpath, wlpath, hash string, cachesize int) {
-	level, err := rawdb.NewLevelDBDatabase(dbpath, cachesize/2, 0, "", false)
+// prefetchStaleLines is how many lookahead windows behind the prefetcher's
+// own position a warm mark is kept before it is pruned: marks older than
+// prefetchStaleLines*lookahead lines are dropped. Since it is above 1, a
+// mark is never evicted before the main loop, trailing behind the
+// prefetcher by up to lookahead lines, could plausibly have reached it.
+const prefetchStaleLines = 4
+
+// runPrefetcher trails the main replay, reading ahead in its own copy of
+// the workload file. It tracks mainLine, the line the main loop is
+// currently on, and never reads more than `lookahead` lines past it,
+// blocking instead of racing ahead. If it falls behind the main loop it
+// keeps reading the lines the main loop has already passed. For each
+// line it decodes the touched addresses/storage slots and issues
+// GetBalance/GetState calls against a throwaway StateDB opened on the
+// latest committed root and the real snapshot tree, warming the shared
+// clean trie cache and snapshot layers before the main loop's ops reach
+// that state, and records what it touched in warm so the main loop can
+// tell whether it arrived in time.
+func runPrefetcher(wlpath string, lookahead int, stateCache state.Database, snaptree *snapshot.Tree, root *latestRoot, mainLine *int64, warm *prefetchWarm) {
+	file, err := os.Open(wlpath)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+
+	statedb, err := state.New(root.get(), stateCache, snaptree)
+	if err != nil {
+		return
+	}
+
+	var line int64
+	sinceRebuild := 0
+	for scanner.Scan() {
+		for line-atomic.LoadInt64(mainLine) >= int64(lookahead) {
+			time.Sleep(time.Millisecond)
+		}
+
+		s := strings.Split(scanner.Text(), " ")
+		switch s[0] {
+		case "getbalance", "addbalance", "subbalance", "getnonce", "setnonce", "getcodehash", "setcode":
+			addr := common.HexToAddress(s[1])
+			statedb.GetBalance(addr)
+			warm.markAccount(addr, line)
+		case "getstate", "setstate":
+			addr := common.HexToAddress(s[1])
+			slot := common.HexToHash(s[2])
+			statedb.GetState(addr, slot)
+			warm.markAccount(addr, line)
+			warm.markStorage(addr, slot, line)
+		}
+
+		line++
+		sinceRebuild++
+		if sinceRebuild >= lookahead {
+			sinceRebuild = 0
+			warm.prune(line - int64(lookahead)*prefetchStaleLines)
+			if db, err := state.New(root.get(), stateCache, snaptree); err == nil {
+				statedb = db
+			}
+		}
+	}
+}
+
+func statedb_benchmark(dbpath, wlpath, hash string, cachesize int, engine Engine, pipelineCommit bool, prefetch int) {
+	level, err := openEngine(dbpath, cachesize, engine)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -93,13 +328,47 @@ func statedb_benchmark(dbpath, wlpath, hash string, cachesize int) {
 		Preimages: defaultCacheConfig.Preimages,
 	})
 
-	statedb, err := state.New(common.HexToHash(hash), stateCache, nil)
+	// TrieCleanNoPrefetch is an explicit global kill switch: even if a
+	// prefetch depth is passed (the seventh command-line argument; there is
+	// no -prefetch flag), setting it disables the prefetcher pipeline.
+	prefetchEnabled := prefetch > 0 && !defaultCacheConfig.TrieCleanNoPrefetch
+
+	// The snapshot tree is only built, and only ever consulted, when
+	// prefetching is enabled: building one at `hash` can fail outright if
+	// that root has no snapshot, and a plain (non-prefetch) run must keep
+	// running the same state.New(..., nil) path it always has.
+	var snaptree *snapshot.Tree
+	if prefetchEnabled {
+		snaptree, err = snapshot.New(level, stateCache.TrieDB(), defaultCacheConfig.SnapshotLimit, common.HexToHash(hash), false, true, false)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+	}
+
+	statedb, err := state.New(common.HexToHash(hash), stateCache, snaptree)
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
 	statedbStats := StateDBStats{}
 
+	// flushResult is primed with a nil error so the first commit's
+	// back-pressure wait returns immediately; it is always refilled before
+	// the next flush is kicked off, bounding in-flight flushes to one.
+	flushResult := make(chan pipelineResult, 1)
+	flushResult <- pipelineResult{}
+
+	var prefetchRoot *latestRoot
+	var mainLine int64
+	var prefetchWarmSet *prefetchWarm
+	prefetchedStats := prefetchStats{}
+	if prefetchEnabled {
+		prefetchRoot = &latestRoot{root: common.HexToHash(hash)}
+		prefetchWarmSet = newPrefetchWarm()
+		go runPrefetcher(wlpath, prefetch, stateCache, snaptree, prefetchRoot, &mainLine, prefetchWarmSet)
+	}
+
 	file, _ := os.Open(wlpath)
 	defer file.Close()
 	scanner := bufio.NewScanner(file)
@@ -112,9 +381,15 @@ func statedb_benchmark(dbpath, wlpath, hash string, cachesize int) {
 	t_put := float64(0)
 	t_commit := float64(0)
 	t_trie_commit := float64(0)
+	t_async_flush := float64(0)
 	blocknum := 0
+	var lineNum int64
 	for scanner.Scan() {
 		s := strings.Split(scanner.Text(), " ")
+		if prefetchEnabled {
+			atomic.StoreInt64(&mainLine, lineNum)
+		}
+		lineNum++
 
 		if s[0] == "blockid" {
 			blocknum, _ = strconv.Atoi(s[1])
@@ -125,7 +400,7 @@ func statedb_benchmark(dbpath, wlpath, hash string, cachesize int) {
 
 		if s[0] == "newstatedb" {
 			hash := common.HexToHash(s[1])
-			statedb, err = state.New(hash, stateCache, nil)
+			statedb, err = state.New(hash, stateCache, snaptree)
 			if err != nil {
 				fmt.Println(err)
 				return
@@ -162,7 +437,6 @@ func statedb_benchmark(dbpath, wlpath, hash string, cachesize int) {
 				return
 			}
 			t_commit += time.Since(substart).Seconds()
-			substart = time.Now()
 
 			/*
 				fmt.Println("commit", blocknum, hex.EncodeToString(root.Bytes()))
@@ -173,10 +447,46 @@ func statedb_benchmark(dbpath, wlpath, hash string, cachesize int) {
 			*/
 
 			triedb := stateCache.TrieDB()
-			if err := triedb.Commit(root, false, nil); err != nil {
-				fmt.Println(err)
+			if pipelineCommit {
+				// Back-pressure: the channel only holds one slot, so this
+				// blocks until the previous block's flush has landed,
+				// bounding the pipeline to a single in-flight commit. Its
+				// elapsed time is asynchronous flush work overlapped with
+				// the next block's critical path, so it is tracked
+				// separately from t_trie_commit rather than folded into it.
+				prev := <-flushResult
+				if prev.err != nil {
+					fmt.Println(prev.err)
+				}
+				t_async_flush += prev.elapsed
+
+				// This goroutine's triedb.Commit(root, ...) runs against
+				// the same *trie.Database as the next block's
+				// statedb.Commit(...) above, which inserts that block's
+				// new dirty nodes into it with no synchronization of our
+				// own here: we rely entirely on trie.Database's internal
+				// lock to make that concurrent insert-vs-flush safe. That
+				// lock also means the two aren't truly running in
+				// parallel for its duration — the measured t_async_flush
+				// win is the overlap of everything outside that
+				// lock-held section (collecting referenced nodes,
+				// writing to the disk kv store), not the whole flush.
+				go func(root common.Hash) {
+					flushStart := time.Now()
+					err := triedb.Commit(root, false, nil)
+					flushResult <- pipelineResult{err: err, elapsed: time.Since(flushStart).Seconds()}
+				}(root)
+			} else {
+				substart = time.Now()
+				if err := triedb.Commit(root, false, nil); err != nil {
+					fmt.Println(err)
+				}
+				t_trie_commit += time.Since(substart).Seconds()
+			}
+
+			if prefetchRoot != nil {
+				prefetchRoot.set(root)
 			}
-			t_trie_commit += time.Since(substart).Seconds()
 
 			blocknum += 1
 
@@ -191,11 +501,21 @@ func statedb_benchmark(dbpath, wlpath, hash string, cachesize int) {
 				fmt.Printf("%d\t%.3f\t%d\t%d\t%.3f\t%s\n",
 					blocknum,
 					elapsed.Seconds(), opget, opput, float64(opcnt)/elapsed.Seconds(), dbsize)
-				fmt.Printf("time %.3f\t%.3f\t%.3f\t%.3f\n", t_get, t_put, t_commit, t_trie_commit)
+				fmt.Printf("time %.3f\t%.3f\t%.3f\t%.3f\t%.3f\n", t_get, t_put, t_commit, t_trie_commit, t_async_flush)
 
 				statedbStats.PrintStats()
 				statedbStats.Reset()
 				stateCache.PrintStats()
+				if engine == EnginePebble {
+					if stats, err := level.Stat(""); err == nil {
+						fmt.Println("pebble stats:", stats)
+					}
+				}
+				if prefetchRoot != nil {
+					hits, misses := prefetchedStats.snapshotAndReset()
+					hitRatio := float64(hits) / math.Max(float64(hits+misses), 1)
+					fmt.Printf("prefetch\t%d\t%d\t%.3f\n", hits, misses, hitRatio)
+				}
 
 				opcnt = 0
 				opget = 0
@@ -204,6 +524,7 @@ func statedb_benchmark(dbpath, wlpath, hash string, cachesize int) {
 				t_put = 0
 				t_commit = 0
 				t_trie_commit = 0
+				t_async_flush = 0
 				timer = time.Now()
 			}
 		}
@@ -234,6 +555,7 @@ func statedb_benchmark(dbpath, wlpath, hash string, cachesize int) {
 			if s[0] == "removeaccount" {
 				//fmt.Println("suicide", hex.EncodeToString(addr.Bytes()))
 				statedb.Suicide(addr)
+				statedbStats.RecordAccountRemoved()
 			}
 		}
 
@@ -266,7 +588,14 @@ func statedb_benchmark(dbpath, wlpath, hash string, cachesize int) {
 			hash := common.HexToHash(s[2])
 			value := common.HexToHash(s[3])
 
+			// Only a transition into the zero value counts as a deletion;
+			// rewriting an already-zero slot to zero is a no-op, not a
+			// slot being cleared.
+			wasZero := statedb.GetState(addr, hash) == (common.Hash{})
 			statedb.SetState(addr, hash, value)
+			if value == (common.Hash{}) && !wasZero {
+				statedbStats.RecordStorageSlotZeroed()
+			}
 			t_put += time.Since(substart).Seconds()
 			opput += 1
 		}
@@ -291,6 +620,13 @@ func statedb_benchmark(dbpath, wlpath, hash string, cachesize int) {
 			statedb.GetBalance(addr)
 			t_get += time.Since(substart).Seconds()
 			opget += 1
+			if prefetchWarmSet != nil {
+				if prefetchWarmSet.hitAccount(addr) {
+					prefetchedStats.recordHit()
+				} else {
+					prefetchedStats.recordMiss()
+				}
+			}
 		}
 		if s[0] == "getstate" {
 			substart := time.Now()
@@ -299,11 +635,29 @@ func statedb_benchmark(dbpath, wlpath, hash string, cachesize int) {
 			statedb.GetState(addr, hash)
 			t_get += time.Since(substart).Seconds()
 			opget += 1
+			if prefetchWarmSet != nil {
+				if prefetchWarmSet.hitStorage(addr, hash) {
+					prefetchedStats.recordHit()
+				} else {
+					prefetchedStats.recordMiss()
+				}
+			}
 		}
 		if s[0] == "finalise" {
 			statedb.Finalise(s[1][:4] == "true")
 		}
 	}
+
+	if pipelineCommit {
+		// Wait for the last in-flight flush to finish and report its
+		// error. Its time is added to t_async_flush, but no timing line
+		// is printed after the loop, so it does not appear in the output.
+		last := <-flushResult
+		if last.err != nil {
+			fmt.Println(last.err)
+		}
+		t_async_flush += last.elapsed
+	}
 }
 
 func main() {
@@ -312,10 +666,22 @@ func main() {
 		wlpath := os.Args[2]
 		cachesize, _ := strconv.Atoi(os.Args[3])
 		hash := ""
-		if len(os.Args) == 5 {
+		if len(os.Args) >= 5 {
 			hash = os.Args[4]
 		}
+		engine := EngineLevelDB
+		if len(os.Args) >= 6 {
+			engine = Engine(os.Args[5])
+		}
+		pipelineCommit := defaultCacheConfig.PipelineCommit
+		if len(os.Args) >= 7 {
+			pipelineCommit = os.Args[6] == "true"
+		}
+		prefetch := 0
+		if len(os.Args) >= 8 {
+			prefetch, _ = strconv.Atoi(os.Args[7])
+		}
 
-		statedb_benchmark(dbpath, wlpath, hash, cachesize)
+		statedb_benchmark(dbpath, wlpath, hash, cachesize, engine, pipelineCommit, prefetch)
 	}
 }
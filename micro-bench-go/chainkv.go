@@ -66,3 +66,7 @@ func (c *ChainKV) Version() common.Hash {
 
 func (c *ChainKV) PrintStats() {
 }
+
+func (c *ChainKV) TriesInMemory() int {
+	return 0
+}
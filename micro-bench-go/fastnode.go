@@ -0,0 +1,179 @@
+package main
+
+import (
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// dummyTrie wraps a real state.Trie but never writes it: gets are
+// served from the snapshot layer (falling back to the disk trie only on a
+// snapshot miss), and updates/commits are no-ops that hand back whatever
+// root they were opened with. It exists so GethFastNode can satisfy the
+// state.Trie shape the stateCache expects without ever touching the MPT.
+type dummyTrie struct {
+	state.Trie
+	snap snapshot.Snapshot
+	root common.Hash
+}
+
+func newDummyTrie(disk state.Trie, snap snapshot.Snapshot, root common.Hash) *dummyTrie {
+	return &dummyTrie{Trie: disk, snap: snap, root: root}
+}
+
+func (t *dummyTrie) TryGet(key []byte) ([]byte, error) {
+	if t.snap != nil {
+		if blob, err := t.snap.AccountRLP(common.BytesToHash(key)); err == nil {
+			return blob, nil
+		}
+	}
+	return t.Trie.TryGet(key)
+}
+
+func (t *dummyTrie) TryUpdate(key, value []byte) error {
+	return nil
+}
+
+func (t *dummyTrie) Commit(onleaf trie.LeafCallback) (common.Hash, error) {
+	return t.root, nil
+}
+
+func (t *dummyTrie) Hash() common.Hash {
+	return t.root
+}
+
+// fastNodeSnapLayers bounds how many snapshot diff layers GethFastNode keeps
+// in memory before capping them down to the disk layer.
+const fastNodeSnapLayers = 128
+
+// GethFastNode is an AuthDB adapter modeled on geth's "fast node" / snapshot
+// only mode: it never builds or persists MPT nodes, instead reading and
+// writing through the snapshot tree. AuthDB has no account/storage split —
+// every key is a flat trie key — so this treats every key as an "account"
+// key against the snapshot's account-keyed layer; there is no storage-slot
+// layer to read or write.
+type GethFastNode struct {
+	level      ethdb.Database
+	stateCache state.Database
+	snaptree   *snapshot.Tree
+	trie       *dummyTrie
+	pending    map[common.Hash][]byte
+	destructs  map[common.Hash]struct{}
+	path       string
+	cachesize  int
+
+	// diskRoot is the only root ever actually persisted to the trie
+	// database: the empty root, since dummyTrie's TryUpdate/Commit never
+	// write anything. The fabricated per-commit snapshot roots are never
+	// flushed to the trie, so the disk-trie fallback must always be opened
+	// here rather than at the synthetic root.
+	diskRoot common.Hash
+}
+
+func NewGethFastNode(dbpath string, cachesize int) *GethFastNode {
+	level, err := rawdb.NewLevelDBDatabase(dbpath, cachesize/2, 0, "", false)
+	if err != nil {
+		panic(err)
+	}
+	stateCache := state.NewDatabaseWithConfig(level, &trie.Config{
+		Cache:     cachesize / 2,
+		Journal:   defaultCacheConfig.TrieCleanJournal,
+		Preimages: defaultCacheConfig.Preimages,
+	})
+	snaptree, err := snapshot.New(level, stateCache.TrieDB(), defaultCacheConfig.SnapshotLimit, common.Hash{}, false, true, false)
+	if err != nil {
+		panic(err)
+	}
+	g := &GethFastNode{level: level, stateCache: stateCache, snaptree: snaptree, path: dbpath, cachesize: cachesize}
+	g.openRoot(common.Hash{})
+	return g
+}
+
+func (g *GethFastNode) openRoot(root common.Hash) {
+	disk, err := g.stateCache.OpenTrie(g.diskRoot)
+	if err != nil {
+		panic(err)
+	}
+	g.trie = newDummyTrie(disk, g.snaptree.Snapshot(root), root)
+	g.pending = make(map[common.Hash][]byte)
+	g.destructs = make(map[common.Hash]struct{})
+}
+
+func (g *GethFastNode) Open(root common.Hash) {
+	g.openRoot(root)
+}
+
+func (g *GethFastNode) Get(key []byte) []byte {
+	// Writes only land in the snapshot tree on Commit, so a key set earlier
+	// in the same uncommitted batch must be served out of pending directly
+	// or it would appear to still hold its pre-batch value.
+	if val, ok := g.pending[common.BytesToHash(key)]; ok {
+		return val
+	}
+	val, err := g.trie.TryGet(key)
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
+
+func (g *GethFastNode) Set(key []byte, value []byte) {
+	g.pending[common.BytesToHash(key)] = value
+}
+
+// Commit folds the pending writes into a new snapshot diff layer. There is
+// no trie to derive a root from, so the root is a keccak256 digest of the
+// parent root and the sorted pending writes, which is enough to give every
+// batch a distinct, deterministic version hash.
+func (g *GethFastNode) Commit() common.Hash {
+	parent := g.trie.Hash()
+
+	keys := make([]common.Hash, 0, len(g.pending))
+	for key := range g.pending {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Cmp(keys[j]) < 0 })
+
+	data := make([][]byte, 0, 2*len(keys)+1)
+	data = append(data, parent.Bytes())
+	for _, key := range keys {
+		data = append(data, key.Bytes(), g.pending[key])
+	}
+	root := crypto.Keccak256Hash(data...)
+
+	if err := g.snaptree.Update(root, parent, g.destructs, g.pending, nil); err != nil {
+		panic(err)
+	}
+	if err := g.snaptree.Cap(root, fastNodeSnapLayers); err != nil {
+		panic(err)
+	}
+	g.openRoot(root)
+	return root
+}
+
+func (g *GethFastNode) Reopen() {
+	g.level.Close()
+	level, err := rawdb.NewLevelDBDatabase(g.path, g.cachesize/2, 0, "", false)
+	if err != nil {
+		panic(err)
+	}
+	g.level = level
+}
+
+func (g *GethFastNode) Version() common.Hash {
+	return g.trie.Hash()
+}
+
+func (g *GethFastNode) PrintStats() {
+	g.trie.PrintStats()
+}
+
+func (g *GethFastNode) TriesInMemory() int {
+	return 0
+}
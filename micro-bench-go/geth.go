@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -20,6 +21,7 @@ type CacheConfig struct {
 	TrieTimeLimit       time.Duration // Time limit after which to flush the current in-memory trie to disk
 	SnapshotLimit       int           // Memory allowance (MB) to use for caching snapshot entries in memory
 	Preimages           bool          // Whether to store preimage of trie key to the disk
+	TriesInMemory       int           // Number of recent tries to keep referenced in memory before flushing
 
 	SnapshotWait bool // Wait for snapshot construction on startup. TODO(karalabe): This is a dirty hack for testing, nuke it
 }
@@ -33,19 +35,40 @@ var defaultCacheConfig = &CacheConfig{
 	TrieCleanJournal: "triejournal",
 	SnapshotLimit:    256,
 	SnapshotWait:     true,
+	TriesInMemory:    128,
 }
 var CacheSize = common.StorageSize(defaultCacheConfig.TrieDirtyLimit * 1024 * 1024)
 
+// Engine selects the on-disk key/value store backing a Geth AuthDB.
+type Engine string
+
+const (
+	EngineLevelDB Engine = "leveldb"
+	EnginePebble  Engine = "pebble"
+)
+
 type Geth struct {
-	level      ethdb.Database
-	stateCache state.Database
-	trie       state.Trie
-	path       string
-	cachesize  int
+	level         ethdb.Database
+	stateCache    state.Database
+	trie          state.Trie
+	path          string
+	cachesize     int
+	engine        Engine
+	triesInMemory int
+	pending       []common.Hash // referenced roots not yet flushed, oldest first
 }
 
-func NewGeth(dbpath string, cachesize int) *Geth {
-	level, err := rawdb.NewLevelDBDatabase(dbpath, cachesize/2, 0, "", false)
+func openEngine(dbpath string, cachesize int, engine Engine) (ethdb.Database, error) {
+	switch engine {
+	case EnginePebble:
+		return rawdb.NewPebbleDBDatabase(dbpath, cachesize/2, 0, "", false, false)
+	default:
+		return rawdb.NewLevelDBDatabase(dbpath, cachesize/2, 0, "", false)
+	}
+}
+
+func newGeth(dbpath string, cachesize int, engine Engine) *Geth {
+	level, err := openEngine(dbpath, cachesize, engine)
 	if err != nil {
 		panic(err)
 	}
@@ -58,7 +81,26 @@ func NewGeth(dbpath string, cachesize int) *Geth {
 	if err != nil {
 		panic(err)
 	}
-	return &Geth{level: level, stateCache: stateCache, trie: trie, path: dbpath, cachesize: cachesize}
+	return &Geth{
+		level:         level,
+		stateCache:    stateCache,
+		trie:          trie,
+		path:          dbpath,
+		cachesize:     cachesize,
+		engine:        engine,
+		triesInMemory: defaultCacheConfig.TriesInMemory,
+	}
+}
+
+func NewGeth(dbpath string, cachesize int) *Geth {
+	return newGeth(dbpath, cachesize, EngineLevelDB)
+}
+
+// NewGethPebble is identical to NewGeth except it backs the trie/state
+// database with Pebble instead of LevelDB, so the two LSM engines can be
+// benchmarked against the same workloads.
+func NewGethPebble(dbpath string, cachesize int) *Geth {
+	return newGeth(dbpath, cachesize, EnginePebble)
 }
 
 func (g *Geth) Open(root common.Hash) {
@@ -69,17 +111,37 @@ func (g *Geth) Open(root common.Hash) {
 	g.trie = trie
 }
 
+// Commit derives the new root and keeps it referenced in memory instead of
+// flushing it straight to disk. Only once more than TriesInMemory roots are
+// held does the oldest one get committed and dereferenced, matching how a
+// live node retains the tries of recent blocks.
 func (g *Geth) Commit() common.Hash {
 	root, err := g.trie.Commit(nil)
 	if err != nil {
 		panic(err)
 	}
-	if err := g.stateCache.TrieDB().Commit(root, false, nil); err != nil {
-		panic(err)
+	triedb := g.stateCache.TrieDB()
+	triedb.Reference(root, common.Hash{})
+	g.pending = append(g.pending, root)
+
+	if len(g.pending) > g.triesInMemory {
+		flush := g.pending[0]
+		g.pending = g.pending[1:]
+		if err := triedb.Commit(flush, false, nil); err != nil {
+			panic(err)
+		}
+		triedb.Dereference(flush)
 	}
 	return root
 }
 
+// TriesInMemory reports how many recent roots are retained in the trie
+// cache before being flushed to disk. Versions within this window can be
+// opened without reconstructing the trie from disk.
+func (g *Geth) TriesInMemory() int {
+	return g.triesInMemory
+}
+
 func (g *Geth) Get(key []byte) []byte {
 	val, err := g.trie.TryGet(key)
 	if err != nil {
@@ -94,7 +156,7 @@ func (g *Geth) Set(key []byte, value []byte) {
 
 func (g *Geth) Reopen() {
 	g.level.Close()
-	level, err := rawdb.NewLevelDBDatabase(g.path, g.cachesize/2, 0, "", false)
+	level, err := openEngine(g.path, g.cachesize, g.engine)
 	if err != nil {
 		panic(err)
 	}
@@ -107,4 +169,9 @@ func (g *Geth) Version() common.Hash {
 
 func (g *Geth) PrintStats() {
 	g.trie.PrintStats()
+	if g.engine == EnginePebble {
+		if stats, err := g.level.Stat(""); err == nil {
+			fmt.Println("pebble stats:", stats)
+		}
+	}
 }